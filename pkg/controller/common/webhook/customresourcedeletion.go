@@ -6,11 +6,19 @@ package webhook
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	extensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/strings/slices"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -27,25 +35,58 @@ import (
 
 const (
 	webhookPath = "/validate-prevent-crd-deletion-k8s-elastic-co"
+
+	// auditNamespacesLimit caps how many in-use namespaces are surfaced in the
+	// elastic.co/in-use-namespaces audit annotation.
+	auditNamespacesLimit = 10
+
+	auditAnnotationBlockedCRD      = "elastic.co/blocked-crd"
+	auditAnnotationInUseNamespaces = "elastic.co/in-use-namespaces"
+	// auditAnnotationInUseCount reports how many Elastic custom resources were found, formatted as
+	// a lower bound (e.g. "10+") rather than an exact total: isInUse stops listing as soon as one
+	// resource is found, so later versions/namespaces that would also match are never counted.
+	auditAnnotationInUseCount     = "elastic.co/in-use-count"
+	auditAnnotationRequestingUser = "elastic.co/requesting-user"
+
+	eventReasonCRDDeletionBlocked = "CRDDeletionBlocked"
+
+	// AllowCRDDeletionAnnotation, when set to "true" on the CRD itself, lets an admin bypass the
+	// deletion protection for that one CRD, e.g. `kubectl annotate crd <name> eck.k8s.elastic.co/allow-crd-deletion=true`.
+	AllowCRDDeletionAnnotation = "eck.k8s.elastic.co/allow-crd-deletion"
 )
 
 var lslog = ulog.Log.WithName("crd-delete-validation")
 
-// RegisterCRDDeletionWebhook will register the crd deletion prevention webhook.
-func RegisterCRDDeletionWebhook(mgr ctrl.Manager, managedNamespace []string) {
+// RegisterCRDDeletionWebhook will register the crd deletion prevention webhook. operatorDeployment
+// identifies the operator's own Deployment, against which events are recorded when a deletion is
+// denied; callers are expected to build it from the operator's own namespace/name (e.g. as exposed
+// to the operator's Deployment via the downward API), not a user-facing flag. No caller wires this
+// up in this tree yet, so it has no effect until one does.
+// disableProtection, wired in from the --disable-crd-deletion-protection operator flag, makes the
+// webhook allow every CRD deletion unconditionally, for use in upgrade/uninstall workflows. That
+// flag registration and the call to RegisterCRDDeletionWebhook itself belong in cmd/manager; no
+// such caller exists in this tree yet, so until one is added this webhook is built but never
+// registered with the manager.
+func RegisterCRDDeletionWebhook(mgr ctrl.Manager, managedNamespace []string, operatorDeployment types.NamespacedName, disableProtection bool) {
 	wh := &crdDeletionWebhook{
-		client:           mgr.GetClient(),
-		decoder:          admission.NewDecoder(mgr.GetScheme()),
-		managedNamespace: set.Make(managedNamespace...),
+		client:             mgr.GetClient(),
+		decoder:            admission.NewDecoder(mgr.GetScheme()),
+		managedNamespace:   set.Make(managedNamespace...),
+		recorder:           mgr.GetEventRecorderFor("elastic-operator"),
+		operatorDeployment: operatorDeployment,
+		disableProtection:  disableProtection,
 	}
-	lslog.Info("Registering CRD deletion prevention validating webhook", "path", webhookPath)
+	lslog.Info("Registering CRD deletion prevention validating webhook", "path", webhookPath, "disabled", disableProtection)
 	mgr.GetWebhookServer().Register(webhookPath, &webhook.Admission{Handler: wh})
 }
 
 type crdDeletionWebhook struct {
-	client           k8s.Client
-	decoder          *admission.Decoder
-	managedNamespace set.StringSet
+	client             k8s.Client
+	decoder            *admission.Decoder
+	managedNamespace   set.StringSet
+	recorder           record.EventRecorder
+	operatorDeployment types.NamespacedName
+	disableProtection  bool
 }
 
 func (wh *crdDeletionWebhook) ValidateCreate(ls *lsv1alpha1.Logstash) error {
@@ -58,20 +99,65 @@ func (wh *crdDeletionWebhook) ValidateUpdate(ctx context.Context, prev *lsv1alph
 
 // Handle is called when any request is sent to the webhook, satisfying the admission.Handler interface.
 func (wh *crdDeletionWebhook) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if wh.disableProtection {
+		return admission.Allowed("")
+	}
+
+	// On a DELETE admission request the API server leaves Object empty and sends the object being
+	// deleted as OldObject.
 	crd := &extensionsv1.CustomResourceDefinition{}
-	err := wh.decoder.DecodeRaw(req.Object, crd)
+	err := wh.decoder.DecodeRaw(req.OldObject, crd)
 	if err != nil {
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 
-	if isElasticCRD(crd.GroupVersionKind()) && wh.isInUse(crd) {
-		return admission.Denied("deletion of Elastic CRDs is not allowed")
+	if !isElasticCRD(crd.Spec.Group) {
+		return admission.Allowed("")
 	}
 
-	return admission.Allowed("")
+	if crd.Annotations[AllowCRDDeletionAnnotation] == "true" {
+		return admission.Allowed("")
+	}
+
+	if req.DryRun != nil && *req.DryRun {
+		return admission.Allowed("")
+	}
+
+	usage := wh.isInUse(crd)
+	if !usage.found {
+		return admission.Allowed("")
+	}
+
+	wh.recordBlockedDeletion(crd, usage, req.UserInfo.Username)
+
+	return admission.Denied("deletion of Elastic CRDs is not allowed").
+		WithAuditAnnotation(auditAnnotationBlockedCRD, crd.Name).
+		WithAuditAnnotation(auditAnnotationInUseNamespaces, strings.Join(usage.topNamespaces(auditNamespacesLimit), ",")).
+		WithAuditAnnotation(auditAnnotationInUseCount, usage.lowerBound()).
+		WithAuditAnnotation(auditAnnotationRequestingUser, req.UserInfo.Username)
 }
 
-func isElasticCRD(gvk schema.GroupVersionKind) bool {
+// recordBlockedDeletion records a Kubernetes Event against the operator's own Deployment
+// summarizing the denied deletion, so that the reason a CRD deletion was blocked is visible
+// without having to dig through apiserver audit logs.
+func (wh *crdDeletionWebhook) recordBlockedDeletion(crd *extensionsv1.CustomResourceDefinition, usage crUsage, username string) {
+	deployment := &appsv1.Deployment{}
+	deployment.Name = wh.operatorDeployment.Name
+	deployment.Namespace = wh.operatorDeployment.Namespace
+
+	wh.recorder.Eventf(
+		deployment,
+		corev1.EventTypeWarning,
+		eventReasonCRDDeletionBlocked,
+		"Denied deletion of CRD %s requested by %s: %s Elastic custom resource(s) still present in namespace(s) %s",
+		crd.Name, username, usage.lowerBound(), strings.Join(usage.topNamespaces(auditNamespacesLimit), ","),
+	)
+}
+
+// isElasticCRD returns true if group is one of the API groups defined by an Elastic CRD. Note
+// this is the group the CRD *defines* (crd.Spec.Group), not the CRD object's own
+// apiextensions.k8s.io group.
+func isElasticCRD(group string) bool {
 	return slices.Contains(
 		[]string{
 			"agent.k8s.elastic.co",
@@ -84,25 +170,131 @@ func isElasticCRD(gvk schema.GroupVersionKind) bool {
 			"logstash.k8s.elastic.co",
 			"maps.k8s.elastic.co",
 			"stackconfigpolicy.k8s.elastic.co",
-		}, gvk.Group)
+		}, group)
 }
 
-func (wh *crdDeletionWebhook) isInUse(crd *extensionsv1.CustomResourceDefinition) bool {
-	ul := &unstructured.UnstructuredList{}
-	ul.SetGroupVersionKind(schema.GroupVersionKind{
-		Group:   crd.GroupVersionKind().Group,
-		Kind:    crd.GroupVersionKind().Kind,
-		Version: crd.GroupVersionKind().Version,
-	})
+// isInUseListLimit bounds the List calls done by isInUse so that a large number of stored
+// objects does not cause the webhook to buffer them all in memory, while still giving us a
+// handful of namespaces to report back for diagnostics.
+const isInUseListLimit = 10
+
+// crUsage summarizes the Elastic custom resources found to still exist for a CRD being deleted.
+// count is always a lower bound, never a total: isInUse/gvkUsage stop listing as soon as a single
+// resource is found, to avoid paying the cost of enumerating every version and namespace just to
+// deny a deletion that was already going to be denied.
+type crUsage struct {
+	found      bool
+	count      int
+	namespaces set.StringSet
+}
+
+// topNamespaces returns up to n namespaces in which live custom resources were found, sorted for
+// stable output.
+func (u crUsage) topNamespaces(n int) []string {
+	namespaces := u.namespaces.AsSlice()
+	sort.Strings(namespaces)
+	if len(namespaces) > n {
+		namespaces = namespaces[:n]
+	}
+	return namespaces
+}
+
+// lowerBound formats count as the lower bound it actually is, e.g. "10+", so that anyone reading
+// the audit annotation or Event isn't misled into thinking it's an exact total.
+func (u crUsage) lowerBound() string {
+	return fmt.Sprintf("%d+", u.count)
+}
+
+// isInUse reports whether at least one custom resource governed by crd exists in the cluster,
+// along with a best-effort summary of where. If a List call fails, it fails closed: found is set
+// even though no resource was seen, and count stays 0. It checks every version declared in
+// crd.Spec.Versions, since the storage version may differ from crd.GroupVersionKind().Version.
+// There is no need to also check Spec.Names.ListKind: client.List on an UnstructuredList strips
+// a trailing "List" suffix before resolving the REST mapping, so it resolves to the same resource
+// as Spec.Names.Kind and would only double the number of List calls.
+func (wh *crdDeletionWebhook) isInUse(crd *extensionsv1.CustomResourceDefinition) crUsage {
+	usage := crUsage{namespaces: set.Make()}
+	group := crd.Spec.Group
+	kind := crd.Spec.Names.Kind
+	for _, version := range crd.Spec.Versions {
+		gvk := schema.GroupVersionKind{Group: group, Version: version.Name, Kind: kind}
+		wh.gvkUsage(gvk, crd.Spec.Scope == extensionsv1.ClusterScoped, &usage)
+		if usage.found {
+			return usage
+		}
+	}
+	return usage
+}
+
+// gvkUsage lists resources of the given gvk, short-circuiting as soon as an item is found.
+// Cluster-scoped CRDs are always listed without a namespace. Namespaced CRDs are first listed
+// cluster-wide in one call; if the operator lacks RBAC to list cluster-wide, we fall back to
+// listing each managed namespace individually.
+func (wh *crdDeletionWebhook) gvkUsage(gvk schema.GroupVersionKind, clusterScoped bool, usage *crUsage) {
+	if clusterScoped {
+		if err := wh.listInto(gvk, "", usage); err != nil {
+			lslog.Error(err, "Failed to list resources", "gvk", gvk)
+			usage.found = true
+		}
+		return
+	}
+
+	err := wh.listInto(gvk, "", usage)
+	if err == nil {
+		return
+	}
+	if !apierrors.IsForbidden(err) {
+		lslog.Error(err, "Failed to list resources", "gvk", gvk)
+		usage.found = true
+		return
+	}
+
+	if len(wh.managedNamespace.AsSlice()) == 0 {
+		// No RBAC to list cluster-wide, and no managed namespaces to fall back to individually:
+		// we cannot determine whether the CRD is in use. Fail closed rather than silently
+		// reporting "not in use", which would let the CRD be deleted while CRs still exist.
+		lslog.Error(err, "No RBAC to list resources cluster-wide and no managed namespaces configured, blocking deletion", "gvk", gvk)
+		usage.found = true
+		return
+	}
+
+	lslog.V(1).Info("No RBAC to list resources cluster-wide, falling back to per-namespace listing", "gvk", gvk)
 	for _, ns := range wh.managedNamespace.AsSlice() {
-		err := wh.client.List(context.Background(), ul, client.InNamespace(ns))
-		if err != nil {
-			lslog.Error(err, "Failed to list resources", "namespace", ns)
-			return true
+		if err := wh.listInto(gvk, ns, usage); err != nil {
+			lslog.Error(err, "Failed to list resources", "namespace", ns, "gvk", gvk)
+			usage.found = true
+			return
 		}
-		if len(ul.Items) > 0 {
-			return true
+		if usage.found {
+			return
 		}
 	}
-	return false
+}
+
+// listInto lists resources of the given gvk in namespace (all namespaces if empty), using a
+// small page size, and merges any items found into usage.
+func (wh *crdDeletionWebhook) listInto(gvk schema.GroupVersionKind, namespace string, usage *crUsage) error {
+	ul := &unstructured.UnstructuredList{}
+	ul.SetGroupVersionKind(gvk)
+
+	opts := []client.ListOption{client.Limit(isInUseListLimit)}
+	if namespace != "" {
+		opts = append(opts, client.InNamespace(namespace))
+	}
+
+	if err := wh.client.List(context.Background(), ul, opts...); err != nil {
+		return err
+	}
+
+	if len(ul.Items) == 0 {
+		return nil
+	}
+	usage.found = true
+	usage.count += len(ul.Items)
+	for _, item := range ul.Items {
+		if ns := item.GetNamespace(); ns != "" {
+			usage.namespaces.Add(ns)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,405 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	extensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/elastic/cloud-on-k8s/v2/pkg/utils/k8s"
+	"github.com/elastic/cloud-on-k8s/v2/pkg/utils/set"
+)
+
+func TestIsElasticCRD(t *testing.T) {
+	for group, expected := range map[string]bool{
+		"elasticsearch.k8s.elastic.co": true,
+		"kibana.k8s.elastic.co":        true,
+		"example.com":                  false,
+		"":                             false,
+	} {
+		assert.Equal(t, expected, isElasticCRD(group), group)
+	}
+}
+
+// fauxGVK is an API group/kind not recognized by isElasticCRD, used to exercise isInUse in
+// isolation without depending on the real Elastic CR types.
+var fauxGVK = schema.GroupVersionKind{Group: "faux.k8s.elastic.co", Version: "v1", Kind: "Faux"}
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	scheme.AddKnownTypeWithName(fauxGVK, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(fauxGVK.GroupVersion().WithKind("FauxList"), &unstructured.UnstructuredList{})
+	return scheme
+}
+
+func newFauxCR(namespace, name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(fauxGVK)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	return u
+}
+
+func newFauxCRD(scope extensionsv1.ResourceScope, versions ...string) *extensionsv1.CustomResourceDefinition {
+	crd := &extensionsv1.CustomResourceDefinition{
+		Spec: extensionsv1.CustomResourceDefinitionSpec{
+			Group: fauxGVK.Group,
+			Names: extensionsv1.CustomResourceDefinitionNames{
+				Kind:     fauxGVK.Kind,
+				ListKind: fauxGVK.Kind + "List",
+			},
+			Scope: scope,
+		},
+	}
+	for _, v := range versions {
+		crd.Spec.Versions = append(crd.Spec.Versions, extensionsv1.CustomResourceDefinitionVersion{Name: v})
+	}
+	return crd
+}
+
+// forbiddenList wraps a k8s.Client and returns a Forbidden error for cluster-wide (no namespace)
+// lists, simulating an operator lacking the RBAC to list a resource across all namespaces.
+type forbiddenList struct {
+	k8s.Client
+}
+
+func (f *forbiddenList) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	for _, o := range opts {
+		o.ApplyToList(listOpts)
+	}
+	if listOpts.Namespace == "" {
+		gvk := schema.GroupVersionKind{}
+		if ul, ok := list.(*unstructured.UnstructuredList); ok {
+			gvk = ul.GroupVersionKind()
+		}
+		return apierrors.NewForbidden(schema.GroupResource{Group: gvk.Group, Resource: gvk.Kind}, "", assert.AnError)
+	}
+	return f.Client.List(ctx, list, opts...)
+}
+
+func TestIsInUse_MultiVersion(t *testing.T) {
+	scheme := newTestScheme(t)
+	obj := newFauxCR("ns1", "my-cr")
+	obj.Object["apiVersion"] = fauxGVK.GroupVersion().String()
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(obj).Build()
+
+	wh := &crdDeletionWebhook{client: k8s.WrapClient(fakeClient), managedNamespace: set.Make()}
+	crd := newFauxCRD(extensionsv1.NamespaceScoped, "v1alpha1", "v1")
+
+	usage := wh.isInUse(crd)
+	assert.True(t, usage.found)
+	assert.Equal(t, 1, usage.count)
+	assert.Equal(t, []string{"ns1"}, usage.topNamespaces(10))
+}
+
+func TestIsInUse_NotInUse(t *testing.T) {
+	scheme := newTestScheme(t)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	wh := &crdDeletionWebhook{client: k8s.WrapClient(fakeClient), managedNamespace: set.Make()}
+	crd := newFauxCRD(extensionsv1.NamespaceScoped, "v1")
+
+	usage := wh.isInUse(crd)
+	assert.False(t, usage.found)
+}
+
+func TestIsInUse_ClusterScoped(t *testing.T) {
+	scheme := newTestScheme(t)
+	obj := newFauxCR("", "my-cluster-cr")
+	obj.Object["apiVersion"] = fauxGVK.GroupVersion().String()
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(obj).Build()
+
+	wh := &crdDeletionWebhook{client: k8s.WrapClient(fakeClient), managedNamespace: set.Make()}
+	crd := newFauxCRD(extensionsv1.ClusterScoped, "v1")
+
+	usage := wh.isInUse(crd)
+	assert.True(t, usage.found)
+}
+
+// TestIsInUse_UnmanagedNamespace verifies that a CR in a namespace the operator does not manage
+// is still detected, since isInUse does a cluster-wide list rather than iterating managedNamespace.
+func TestIsInUse_UnmanagedNamespace(t *testing.T) {
+	scheme := newTestScheme(t)
+	obj := newFauxCR("some-other-ns", "my-cr")
+	obj.Object["apiVersion"] = fauxGVK.GroupVersion().String()
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(obj).Build()
+
+	wh := &crdDeletionWebhook{client: k8s.WrapClient(fakeClient), managedNamespace: set.Make("managed-ns")}
+	crd := newFauxCRD(extensionsv1.NamespaceScoped, "v1")
+
+	usage := wh.isInUse(crd)
+	assert.True(t, usage.found)
+}
+
+func TestIsInUse_RBACFallback(t *testing.T) {
+	scheme := newTestScheme(t)
+	obj := newFauxCR("managed-ns", "my-cr")
+	obj.Object["apiVersion"] = fauxGVK.GroupVersion().String()
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(obj).Build()
+
+	wh := &crdDeletionWebhook{
+		client:           &forbiddenList{Client: k8s.WrapClient(fakeClient)},
+		managedNamespace: set.Make("managed-ns"),
+	}
+	crd := newFauxCRD(extensionsv1.NamespaceScoped, "v1")
+
+	usage := wh.isInUse(crd)
+	assert.True(t, usage.found)
+}
+
+// TestIsInUse_RBACFallbackNoManagedNamespace verifies the fail-closed behavior: if the operator
+// cannot list cluster-wide and has no managed namespaces configured to fall back to, isInUse must
+// not silently report "not in use".
+func TestIsInUse_RBACFallbackNoManagedNamespace(t *testing.T) {
+	scheme := newTestScheme(t)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	wh := &crdDeletionWebhook{
+		client:           &forbiddenList{Client: k8s.WrapClient(fakeClient)},
+		managedNamespace: set.Make(),
+	}
+	crd := newFauxCRD(extensionsv1.NamespaceScoped, "v1")
+
+	usage := wh.isInUse(crd)
+	assert.True(t, usage.found)
+}
+
+// elasticGVK is a recognized Elastic CR group/kind, used to exercise Handle's full
+// isElasticCRD/isInUse/audit-annotation/event path.
+var elasticGVK = schema.GroupVersionKind{Group: "elasticsearch.k8s.elastic.co", Version: "v1", Kind: "Elasticsearch"}
+
+func newHandleTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	scheme.AddKnownTypeWithName(elasticGVK, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(elasticGVK.GroupVersion().WithKind("ElasticsearchList"), &unstructured.UnstructuredList{})
+	return scheme
+}
+
+func newDeleteRequest(t *testing.T, crd *extensionsv1.CustomResourceDefinition, username string, dryRun *bool) admission.Request {
+	t.Helper()
+	raw, err := json.Marshal(crd)
+	require.NoError(t, err)
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Delete,
+			OldObject: runtime.RawExtension{Raw: raw},
+			UserInfo:  authenticationv1.UserInfo{Username: username},
+			DryRun:    dryRun,
+		},
+	}
+}
+
+func TestHandle_DeniesAndAnnotatesInUseCRD(t *testing.T) {
+	scheme := newHandleTestScheme(t)
+	cr := &unstructured.Unstructured{}
+	cr.SetGroupVersionKind(elasticGVK)
+	cr.SetNamespace("ns1")
+	cr.SetName("my-es")
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(cr).Build()
+	recorder := record.NewFakeRecorder(1)
+
+	crd := &extensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "elasticsearches.elasticsearch.k8s.elastic.co"},
+		Spec: extensionsv1.CustomResourceDefinitionSpec{
+			Group: elasticGVK.Group,
+			Names: extensionsv1.CustomResourceDefinitionNames{Kind: elasticGVK.Kind, ListKind: elasticGVK.Kind + "List"},
+			Scope: extensionsv1.NamespaceScoped,
+			Versions: []extensionsv1.CustomResourceDefinitionVersion{
+				{Name: elasticGVK.Version},
+			},
+		},
+	}
+
+	wh := &crdDeletionWebhook{
+		client:             k8s.WrapClient(fakeClient),
+		decoder:            admission.NewDecoder(scheme),
+		managedNamespace:   set.Make("ns1"),
+		recorder:           recorder,
+		operatorDeployment: types.NamespacedName{Namespace: "elastic-system", Name: "elastic-operator"},
+	}
+
+	resp := wh.Handle(context.Background(), newDeleteRequest(t, crd, "jdoe", nil))
+
+	require.False(t, resp.Allowed)
+	require.NotNil(t, resp.AuditAnnotations)
+	assert.Equal(t, crd.Name, resp.AuditAnnotations[auditAnnotationBlockedCRD])
+	assert.Equal(t, "ns1", resp.AuditAnnotations[auditAnnotationInUseNamespaces])
+	assert.Equal(t, "1+", resp.AuditAnnotations[auditAnnotationInUseCount])
+	assert.Equal(t, "jdoe", resp.AuditAnnotations[auditAnnotationRequestingUser])
+
+	select {
+	case event := <-recorder.Events:
+		assert.Contains(t, event, eventReasonCRDDeletionBlocked)
+		assert.Contains(t, event, "jdoe")
+	default:
+		t.Fatal("expected an event to be recorded")
+	}
+}
+
+func TestHandle_AllowsUnusedCRD(t *testing.T) {
+	scheme := newHandleTestScheme(t)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	crd := &extensionsv1.CustomResourceDefinition{
+		Spec: extensionsv1.CustomResourceDefinitionSpec{
+			Group: elasticGVK.Group,
+			Names: extensionsv1.CustomResourceDefinitionNames{Kind: elasticGVK.Kind, ListKind: elasticGVK.Kind + "List"},
+			Scope: extensionsv1.NamespaceScoped,
+			Versions: []extensionsv1.CustomResourceDefinitionVersion{
+				{Name: elasticGVK.Version},
+			},
+		},
+	}
+
+	wh := &crdDeletionWebhook{
+		client:           k8s.WrapClient(fakeClient),
+		decoder:          admission.NewDecoder(scheme),
+		managedNamespace: set.Make("ns1"),
+		recorder:         record.NewFakeRecorder(1),
+	}
+
+	resp := wh.Handle(context.Background(), newDeleteRequest(t, crd, "jdoe", nil))
+	assert.True(t, resp.Allowed)
+}
+
+func TestHandle_AllowsWhenDisableProtectionFlagSet(t *testing.T) {
+	scheme := newHandleTestScheme(t)
+	cr := &unstructured.Unstructured{}
+	cr.SetGroupVersionKind(elasticGVK)
+	cr.SetNamespace("ns1")
+	cr.SetName("my-es")
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(cr).Build()
+
+	crd := &extensionsv1.CustomResourceDefinition{
+		Spec: extensionsv1.CustomResourceDefinitionSpec{
+			Group:    elasticGVK.Group,
+			Names:    extensionsv1.CustomResourceDefinitionNames{Kind: elasticGVK.Kind, ListKind: elasticGVK.Kind + "List"},
+			Scope:    extensionsv1.NamespaceScoped,
+			Versions: []extensionsv1.CustomResourceDefinitionVersion{{Name: elasticGVK.Version}},
+		},
+	}
+
+	wh := &crdDeletionWebhook{
+		client:            k8s.WrapClient(fakeClient),
+		decoder:           admission.NewDecoder(scheme),
+		managedNamespace:  set.Make("ns1"),
+		recorder:          record.NewFakeRecorder(1),
+		disableProtection: true,
+	}
+
+	resp := wh.Handle(context.Background(), newDeleteRequest(t, crd, "jdoe", nil))
+	assert.True(t, resp.Allowed)
+}
+
+func TestHandle_AllowsWhenAllowCRDDeletionAnnotationSet(t *testing.T) {
+	scheme := newHandleTestScheme(t)
+	cr := &unstructured.Unstructured{}
+	cr.SetGroupVersionKind(elasticGVK)
+	cr.SetNamespace("ns1")
+	cr.SetName("my-es")
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(cr).Build()
+
+	crd := &extensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AllowCRDDeletionAnnotation: "true"}},
+		Spec: extensionsv1.CustomResourceDefinitionSpec{
+			Group:    elasticGVK.Group,
+			Names:    extensionsv1.CustomResourceDefinitionNames{Kind: elasticGVK.Kind, ListKind: elasticGVK.Kind + "List"},
+			Scope:    extensionsv1.NamespaceScoped,
+			Versions: []extensionsv1.CustomResourceDefinitionVersion{{Name: elasticGVK.Version}},
+		},
+	}
+
+	wh := &crdDeletionWebhook{
+		client:           k8s.WrapClient(fakeClient),
+		decoder:          admission.NewDecoder(scheme),
+		managedNamespace: set.Make("ns1"),
+		recorder:         record.NewFakeRecorder(1),
+	}
+
+	resp := wh.Handle(context.Background(), newDeleteRequest(t, crd, "jdoe", nil))
+	assert.True(t, resp.Allowed)
+}
+
+func TestHandle_AllowsDryRunWithoutListing(t *testing.T) {
+	scheme := newHandleTestScheme(t)
+	// No objects registered, and the client used here panics on List so that a regression
+	// calling isInUse during a dry run would fail the test rather than just passing by luck.
+	fakeClient := &panicsOnListClient{Client: k8s.WrapClient(fake.NewClientBuilder().WithScheme(scheme).Build())}
+
+	crd := &extensionsv1.CustomResourceDefinition{
+		Spec: extensionsv1.CustomResourceDefinitionSpec{
+			Group:    elasticGVK.Group,
+			Names:    extensionsv1.CustomResourceDefinitionNames{Kind: elasticGVK.Kind, ListKind: elasticGVK.Kind + "List"},
+			Scope:    extensionsv1.NamespaceScoped,
+			Versions: []extensionsv1.CustomResourceDefinitionVersion{{Name: elasticGVK.Version}},
+		},
+	}
+
+	wh := &crdDeletionWebhook{
+		client:           fakeClient,
+		decoder:          admission.NewDecoder(scheme),
+		managedNamespace: set.Make("ns1"),
+		recorder:         record.NewFakeRecorder(1),
+	}
+
+	dryRun := true
+	resp := wh.Handle(context.Background(), newDeleteRequest(t, crd, "jdoe", &dryRun))
+	assert.True(t, resp.Allowed)
+}
+
+// panicsOnListClient wraps a k8s.Client and panics if List is ever called, used to assert that a
+// code path does not perform any List calls.
+type panicsOnListClient struct {
+	k8s.Client
+}
+
+func (p *panicsOnListClient) List(context.Context, client.ObjectList, ...client.ListOption) error {
+	panic("List should not be called")
+}
+
+func TestHandle_AllowsNonElasticCRD(t *testing.T) {
+	scheme := newHandleTestScheme(t)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	crd := &extensionsv1.CustomResourceDefinition{
+		Spec: extensionsv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Names: extensionsv1.CustomResourceDefinitionNames{Kind: "Widget"},
+			Scope: extensionsv1.NamespaceScoped,
+		},
+	}
+
+	wh := &crdDeletionWebhook{
+		client:   k8s.WrapClient(fakeClient),
+		decoder:  admission.NewDecoder(scheme),
+		recorder: record.NewFakeRecorder(1),
+	}
+
+	resp := wh.Handle(context.Background(), newDeleteRequest(t, crd, "jdoe", nil))
+	assert.True(t, resp.Allowed)
+}
@@ -0,0 +1,152 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/strings/slices"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/elastic/cloud-on-k8s/v2/pkg/utils/k8s"
+	ulog "github.com/elastic/cloud-on-k8s/v2/pkg/utils/log"
+)
+
+// +kubebuilder:webhook:path=/mutate-protect-crs-k8s-elastic-co,mutating=true,failurePolicy=ignore,groups=agent.k8s.elastic.co;apm.k8s.elastic.co;autoscaling.k8s.elastic.co;beat.k8s.elastic.co;elasticsearch.k8s.elastic.co;enterprise-search.k8s.elastic.co;kibana.k8s.elastic.co;logstash.k8s.elastic.co;maps.k8s.elastic.co;stackconfigpolicy.k8s.elastic.co,resources=agents;apmservers;elasticsearchautoscalers;beats;elasticsearches;enterprisesearches;kibanas;logstashes;elasticmapsservers;stackconfigpolicies,verbs=create,versions=v1;v1alpha1;v1beta1,name=elastic-protect-crs.k8s.elastic.co,sideEffects=None,admissionReviewVersions=v1,matchPolicy=Exact
+// +kubebuilder:webhook:path=/validate-protect-crs-k8s-elastic-co,mutating=false,failurePolicy=ignore,groups=agent.k8s.elastic.co;apm.k8s.elastic.co;autoscaling.k8s.elastic.co;beat.k8s.elastic.co;elasticsearch.k8s.elastic.co;enterprise-search.k8s.elastic.co;kibana.k8s.elastic.co;logstash.k8s.elastic.co;maps.k8s.elastic.co;stackconfigpolicy.k8s.elastic.co,resources=agents;apmservers;elasticsearchautoscalers;beats;elasticsearches;enterprisesearches;kibanas;logstashes;elasticmapsservers;stackconfigpolicies,verbs=delete,versions=v1;v1alpha1;v1beta1,name=elastic-protect-crs-delete.k8s.elastic.co,sideEffects=None,admissionReviewVersions=v1,matchPolicy=Exact
+
+const (
+	mutatingProtectionWebhookPath   = "/mutate-protect-crs-k8s-elastic-co"
+	validatingProtectionWebhookPath = "/validate-protect-crs-k8s-elastic-co"
+
+	// ProtectOnDeleteAnnotation, when set to "true" on an Elastic custom resource, opts it into
+	// delete protection: a finalizer is injected on creation and deletion is denied for as long
+	// as the annotation remains "true".
+	ProtectOnDeleteAnnotation = "eck.k8s.elastic.co/protect-on-delete"
+
+	// ProtectionFinalizer is added to an Elastic custom resource when it is protected, requiring
+	// users to unprotect it (remove or flip the annotation) before it can be deleted.
+	ProtectionFinalizer = "finalizer.k8s.elastic.co/protection"
+)
+
+var crProtectionLog = ulog.Log.WithName("cr-delete-protection")
+
+// RegisterCRDeletionProtectionWebhooks registers the mutating webhook that injects
+// ProtectionFinalizer on creation of protected Elastic custom resources, and the companion
+// validating webhook that denies their deletion while still protected. alwaysProtect makes
+// every Elastic custom resource protected regardless of the per-resource annotation; callers are
+// expected to wire it from an operator-wide flag (mirroring how RegisterCRDDeletionWebhook's
+// disableProtection is wired from --disable-crd-deletion-protection) rather than hardcoding it.
+func RegisterCRDeletionProtectionWebhooks(mgr ctrl.Manager, alwaysProtect bool) {
+	mutator := &crProtectionInjector{
+		decoder:       admission.NewDecoder(mgr.GetScheme()),
+		alwaysProtect: alwaysProtect,
+	}
+	validator := &crProtectionValidator{
+		decoder:       admission.NewDecoder(mgr.GetScheme()),
+		alwaysProtect: alwaysProtect,
+	}
+	crProtectionLog.Info("Registering CR deletion protection webhooks", "mutating_path", mutatingProtectionWebhookPath, "validating_path", validatingProtectionWebhookPath)
+	mgr.GetWebhookServer().Register(mutatingProtectionWebhookPath, &webhook.Admission{Handler: mutator})
+	mgr.GetWebhookServer().Register(validatingProtectionWebhookPath, &webhook.Admission{Handler: validator})
+}
+
+// crProtectionInjector injects ProtectionFinalizer on CREATE of an Elastic custom resource that
+// opted into delete protection, satisfying the admission.Handler interface.
+type crProtectionInjector struct {
+	decoder       *admission.Decoder
+	alwaysProtect bool
+}
+
+func (m *crProtectionInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	obj := &unstructured.Unstructured{}
+	if err := m.decoder.DecodeRaw(req.Object, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if !isProtected(obj, m.alwaysProtect) {
+		return admission.Allowed("")
+	}
+
+	finalizers := obj.GetFinalizers()
+	if slices.Contains(finalizers, ProtectionFinalizer) {
+		return admission.Allowed("")
+	}
+	obj.SetFinalizers(append(finalizers, ProtectionFinalizer))
+
+	marshaled, err := json.Marshal(obj)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// crProtectionValidator denies DELETE of an Elastic custom resource that is still protected,
+// so the guard holds even if ProtectionFinalizer was stripped by some other actor.
+type crProtectionValidator struct {
+	decoder       *admission.Decoder
+	alwaysProtect bool
+}
+
+func (v *crProtectionValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	obj := &unstructured.Unstructured{}
+	if err := v.decoder.DecodeRaw(req.OldObject, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if isProtected(obj, v.alwaysProtect) {
+		return admission.Denied("deletion of this resource is not allowed while it is protected, remove the " + ProtectOnDeleteAnnotation + " annotation first")
+	}
+
+	return admission.Allowed("")
+}
+
+// isProtected returns true if obj opted into delete protection, either via alwaysProtect or via
+// the ProtectOnDeleteAnnotation annotation set to "true".
+func isProtected(obj metav1.Object, alwaysProtect bool) bool {
+	if alwaysProtect {
+		return true
+	}
+	return obj.GetAnnotations()[ProtectOnDeleteAnnotation] == "true"
+}
+
+// ReconcileProtectionFinalizer removes ProtectionFinalizer from obj if obj is marked for deletion
+// and is no longer protected, letting a pending `kubectl delete` proceed. Every controller for a
+// CR type covered by RegisterCRDeletionProtectionWebhooks must call this as part of its
+// reconciliation loop: crProtectionValidator only admits or denies the DELETE request, it does
+// not remove the finalizer itself, so without this the two-step
+// "unprotect then delete" workflow would leave the resource stuck in Terminating forever.
+func ReconcileProtectionFinalizer(ctx context.Context, c k8s.Client, obj client.Object, alwaysProtect bool) error {
+	if obj.GetDeletionTimestamp().IsZero() {
+		return nil
+	}
+	if isProtected(obj, alwaysProtect) {
+		return nil
+	}
+
+	finalizers := obj.GetFinalizers()
+	if !slices.Contains(finalizers, ProtectionFinalizer) {
+		return nil
+	}
+	obj.SetFinalizers(removeFinalizer(finalizers, ProtectionFinalizer))
+	return c.Update(ctx, obj)
+}
+
+func removeFinalizer(finalizers []string, target string) []string {
+	kept := make([]string, 0, len(finalizers))
+	for _, f := range finalizers {
+		if f != target {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,130 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/elastic/cloud-on-k8s/v2/pkg/utils/k8s"
+)
+
+func newProtectableUnstructured(protect bool, finalizers ...string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(fauxGVK)
+	u.SetNamespace("ns1")
+	u.SetName("my-cr")
+	if protect {
+		u.SetAnnotations(map[string]string{ProtectOnDeleteAnnotation: "true"})
+	}
+	if len(finalizers) > 0 {
+		u.SetFinalizers(finalizers)
+	}
+	return u
+}
+
+func TestCRProtectionInjector_Handle(t *testing.T) {
+	for name, tc := range map[string]struct {
+		protect            bool
+		alwaysProtect      bool
+		existingFinalizers []string
+		expectPatch        bool
+	}{
+		"not opted in, no alwaysProtect": {protect: false, alwaysProtect: false, expectPatch: false},
+		"opted in via annotation":        {protect: true, alwaysProtect: false, expectPatch: true},
+		"opted in via alwaysProtect":     {protect: false, alwaysProtect: true, expectPatch: true},
+		"already has finalizer":          {protect: true, alwaysProtect: false, existingFinalizers: []string{ProtectionFinalizer}, expectPatch: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			obj := newProtectableUnstructured(tc.protect, tc.existingFinalizers...)
+			raw, err := json.Marshal(obj)
+			require.NoError(t, err)
+
+			m := &crProtectionInjector{
+				decoder:       admission.NewDecoder(clientgoscheme.Scheme),
+				alwaysProtect: tc.alwaysProtect,
+			}
+			resp := m.Handle(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Object: runtime.RawExtension{Raw: raw},
+				},
+			})
+
+			require.True(t, resp.Allowed)
+			if tc.expectPatch {
+				assert.NotEmpty(t, resp.Patches)
+			} else {
+				assert.Empty(t, resp.Patches)
+			}
+		})
+	}
+}
+
+func TestCRProtectionValidator_Handle(t *testing.T) {
+	for name, tc := range map[string]struct {
+		protect bool
+		allowed bool
+	}{
+		"protected, deletion denied":     {protect: true, allowed: false},
+		"not protected, deletion allowed": {protect: false, allowed: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			obj := newProtectableUnstructured(tc.protect)
+			raw, err := json.Marshal(obj)
+			require.NoError(t, err)
+
+			v := &crProtectionValidator{decoder: admission.NewDecoder(clientgoscheme.Scheme)}
+			resp := v.Handle(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					OldObject: runtime.RawExtension{Raw: raw},
+				},
+			})
+
+			assert.Equal(t, tc.allowed, resp.Allowed)
+		})
+	}
+}
+
+func TestReconcileProtectionFinalizer(t *testing.T) {
+	now := metav1.Now()
+
+	t.Run("not being deleted: finalizer untouched", func(t *testing.T) {
+		obj := newProtectableUnstructured(false, ProtectionFinalizer)
+		c := k8s.WrapClient(fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithRuntimeObjects(obj).Build())
+
+		require.NoError(t, ReconcileProtectionFinalizer(context.Background(), c, obj, false))
+		assert.Contains(t, obj.GetFinalizers(), ProtectionFinalizer)
+	})
+
+	t.Run("being deleted but still protected: finalizer kept", func(t *testing.T) {
+		obj := newProtectableUnstructured(true, ProtectionFinalizer)
+		obj.SetDeletionTimestamp(&now)
+		c := k8s.WrapClient(fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithRuntimeObjects(obj).Build())
+
+		require.NoError(t, ReconcileProtectionFinalizer(context.Background(), c, obj, false))
+		assert.Contains(t, obj.GetFinalizers(), ProtectionFinalizer)
+	})
+
+	t.Run("being deleted and unprotected: finalizer removed", func(t *testing.T) {
+		obj := newProtectableUnstructured(false, ProtectionFinalizer, "some-other-finalizer")
+		obj.SetDeletionTimestamp(&now)
+		c := k8s.WrapClient(fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithRuntimeObjects(obj).Build())
+
+		require.NoError(t, ReconcileProtectionFinalizer(context.Background(), c, obj, false))
+		assert.NotContains(t, obj.GetFinalizers(), ProtectionFinalizer)
+		assert.Contains(t, obj.GetFinalizers(), "some-other-finalizer")
+	})
+}